@@ -0,0 +1,271 @@
+package pay
+
+import (
+	"container/list"
+	"crypto/aes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// NotifyStore 保证同一笔交易的业务回调只被执行一次。微信的回调通知在商户未及时
+// 回复 SUCCESS 时会重复投递，HandleNotify/HandleRefundNotify 依赖它做幂等去重
+type NotifyStore interface {
+	// Seen 返回 key 此前是否已经成功处理过，只做查询，不会把 key 记为已处理
+	Seen(key string) bool
+	// MarkSeen 在业务回调成功处理后记录 key，后续相同 key 的通知会被 Seen 挡住
+	MarkSeen(key string)
+}
+
+// defaultNotifyStoreCapacity 是默认 LRU NotifyStore 的容量上限
+const defaultNotifyStoreCapacity = 10000
+
+// lruNotifyStore 是 NotifyStore 的默认实现：超出容量时淘汰最久未被访问的 key
+type lruNotifyStore struct {
+	mu       sync.Mutex
+	capacity int
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+func newLRUNotifyStore(capacity int) *lruNotifyStore {
+	return &lruNotifyStore{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element, capacity),
+	}
+}
+
+func (s *lruNotifyStore) Seen(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.ll.MoveToFront(el)
+		return true
+	}
+	return false
+}
+
+func (s *lruNotifyStore) MarkSeen(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.ll.MoveToFront(el)
+		return
+	}
+	el := s.ll.PushFront(key)
+	s.items[key] = el
+	if s.ll.Len() > s.capacity {
+		oldest := s.ll.Back()
+		if oldest != nil {
+			s.ll.Remove(oldest)
+			delete(s.items, oldest.Value.(string))
+		}
+	}
+}
+
+// notifyStore 返回配置的 NotifyStore，未配置时惰性创建默认的内存 LRU 实现
+func (pcf *Pay) notifyStore() NotifyStore {
+	pcf.notifyStoreOnce.Do(func() {
+		if pcf.NotifyStore == nil {
+			pcf.NotifyStore = newLRUNotifyStore(defaultNotifyStoreCapacity)
+		}
+	})
+	return pcf.NotifyStore
+}
+
+// xmlFields 把单层 <xml><key>value</key>...</xml> 解析为 map[string]string，
+// 保留未知字段，用于在不依赖固定结构体的情况下重新计算签名
+type xmlFields map[string]string
+
+func (m *xmlFields) UnmarshalXML(d *xml.Decoder, _ xml.StartElement) error {
+	*m = xmlFields{}
+	for {
+		var e struct {
+			XMLName xml.Name
+			Value   string `xml:",chardata"`
+		}
+		if err := d.Decode(&e); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		(*m)[e.XMLName.Local] = e.Value
+	}
+	return nil
+}
+
+// writeNotifyReply 写出微信要求的 <xml><return_code>...</return_code>...</xml> 确认报文
+func writeNotifyReply(w http.ResponseWriter, success bool, msg string) {
+	returnCode := "SUCCESS"
+	if !success {
+		returnCode = "FAIL"
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, "<xml><return_code><![CDATA[%s]]></return_code><return_msg><![CDATA[%s]]></return_msg></xml>", returnCode, msg)
+}
+
+// HandleNotify 处理支付结果通知：校验签名、通过 NotifyStore 保证同一笔交易只触发一次 fn，
+// 并按微信要求回复确认 XML。重试的通知会被去重，不会重复执行 fn
+func (pcf *Pay) HandleNotify(w http.ResponseWriter, r *http.Request, fn func(*OrderQueryResult) error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeNotifyReply(w, false, "读取请求失败")
+		return
+	}
+
+	var fields xmlFields
+	if err := xml.Unmarshal(body, &fields); err != nil {
+		writeNotifyReply(w, false, "解析通知失败")
+		return
+	}
+
+	signType := fields["sign_type"]
+	if signType == "" {
+		signType = pcf.signType()
+	}
+	gotSign := fields["sign"]
+	if gotSign == "" || Sign(fields, pcf.PayKey, signType) != gotSign {
+		writeNotifyReply(w, false, "签名验证失败")
+		return
+	}
+
+	var oqr OrderQueryResult
+	if err := xml.Unmarshal(body, &oqr); err != nil {
+		writeNotifyReply(w, false, "解析通知失败")
+		return
+	}
+	if oqr.ReturnCode != "SUCCESS" || oqr.ResultCode != "SUCCESS" {
+		writeNotifyReply(w, false, "订单未支付成功")
+		return
+	}
+
+	if pcf.notifyStore().Seen(oqr.TransactionID) {
+		writeNotifyReply(w, true, "OK")
+		return
+	}
+	if err := fn(&oqr); err != nil {
+		writeNotifyReply(w, false, err.Error())
+		return
+	}
+	pcf.notifyStore().MarkSeen(oqr.TransactionID)
+	writeNotifyReply(w, true, "OK")
+}
+
+// RefundNotifyResult 是退款回调通知中 req_info 解密后的内容
+type RefundNotifyResult struct {
+	TransactionID       string `xml:"transaction_id"`
+	OutTradeNo          string `xml:"out_trade_no"`
+	RefundID            string `xml:"refund_id"`
+	OutRefundNo         string `xml:"out_refund_no"`
+	TotalFee            int    `xml:"total_fee"`
+	SettlementTotalFee  int    `xml:"settlement_total_fee,omitempty"`
+	RefundFee           int    `xml:"refund_fee"`
+	SettlementRefundFee int    `xml:"settlement_refund_fee,omitempty"`
+	RefundStatus        string `xml:"refund_status"` // SUCCESS/CHANGE/REFUNDCLOSE
+	SuccessTime         string `xml:"success_time,omitempty"`
+	RefundAccount       string `xml:"refund_account,omitempty"`
+	RefundRecvAccout    string `xml:"refund_recv_accout,omitempty"`
+	RefundRequestSource string `xml:"refund_request_source,omitempty"`
+}
+
+type refundNotifyEnvelope struct {
+	ReturnCode string `xml:"return_code"`
+	ReturnMsg  string `xml:"return_msg"`
+	AppID      string `xml:"appid,omitempty"`
+	MchID      string `xml:"mch_id,omitempty"`
+	NonceStr   string `xml:"nonce_str,omitempty"`
+	ReqInfo    string `xml:"req_info,omitempty"`
+}
+
+// HandleRefundNotify 处理退款回调通知，req_info 字段使用 md5(PayKey) 作为密钥以 AES-256-ECB 加密，
+// 这是退款通知特有的保护方式（支付通知直接用 sign 字段验签，退款通知没有 sign，靠加密本身防伪造）
+func (pcf *Pay) HandleRefundNotify(w http.ResponseWriter, r *http.Request, fn func(*RefundNotifyResult) error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeNotifyReply(w, false, "读取请求失败")
+		return
+	}
+
+	var envelope refundNotifyEnvelope
+	if err := xml.Unmarshal(body, &envelope); err != nil {
+		writeNotifyReply(w, false, "解析通知失败")
+		return
+	}
+	if envelope.ReturnCode != "SUCCESS" {
+		writeNotifyReply(w, false, "通信失败")
+		return
+	}
+
+	plain, err := decryptReqInfo(envelope.ReqInfo, pcf.PayKey)
+	if err != nil {
+		writeNotifyReply(w, false, "解密req_info失败")
+		return
+	}
+
+	var result RefundNotifyResult
+	if err := xml.Unmarshal(plain, &result); err != nil {
+		writeNotifyReply(w, false, "解析req_info失败")
+		return
+	}
+
+	refundKey := "refund:" + result.RefundID
+	if pcf.notifyStore().Seen(refundKey) {
+		writeNotifyReply(w, true, "OK")
+		return
+	}
+	if err := fn(&result); err != nil {
+		writeNotifyReply(w, false, err.Error())
+		return
+	}
+	pcf.notifyStore().MarkSeen(refundKey)
+	writeNotifyReply(w, true, "OK")
+}
+
+// decryptReqInfo 用 md5(payKey) 的十六进制串作为 AES-256 密钥，对 base64 编码的 req_info 做 ECB 解密
+func decryptReqInfo(reqInfo, payKey string) ([]byte, error) {
+	sum := md5.Sum([]byte(payKey))
+	key := []byte(hex.EncodeToString(sum[:]))
+	ciphertext, err := base64.StdEncoding.DecodeString(reqInfo)
+	if err != nil {
+		return nil, err
+	}
+	return decryptAESECB(key, ciphertext)
+}
+
+// decryptAESECB 是标准库未提供的 ECB 模式：逐块解密后去掉 PKCS7 填充
+func decryptAESECB(key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	size := block.BlockSize()
+	if len(ciphertext) == 0 || len(ciphertext)%size != 0 {
+		return nil, errors.New("[msg : invalidCiphertext] 密文长度不是块大小的整数倍")
+	}
+	plain := make([]byte, len(ciphertext))
+	for bs := 0; bs < len(ciphertext); bs += size {
+		block.Decrypt(plain[bs:bs+size], ciphertext[bs:bs+size])
+	}
+	return pkcs7Unpad(plain)
+}
+
+func pkcs7Unpad(data []byte) ([]byte, error) {
+	n := len(data)
+	if n == 0 {
+		return nil, errors.New("[msg : invalidPadding] 数据为空")
+	}
+	pad := int(data[n-1])
+	if pad == 0 || pad > n {
+		return nil, errors.New("[msg : invalidPadding] 填充长度非法")
+	}
+	return data[:n-pad], nil
+}
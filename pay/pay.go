@@ -1,26 +1,69 @@
 package pay
 
 import (
+	"crypto/tls"
 	"encoding/xml"
 	"errors"
-	"fmt"
 	"io/ioutil"
 	"net/http"
-	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/aimo-x/wechat/context"
 	"github.com/aimo-x/wechat/util"
 )
 
-var payGateway = "https://api.mch.weixin.qq.com/pay/unifiedorder"
-var orderQueryURI = "https://api.mch.weixin.qq.com/pay/orderquery"
-var orderQueryURI2 = "https://api2.mch.weixin.qq.com/pay/orderquery"
+const unifiedorderPath = "/pay/unifiedorder"
+const orderQueryPath = "/pay/orderquery"
 
 // Pay struct extends context
 type Pay struct {
 	*context.Context
+
+	SignType    string      // 签名算法，SignTypeMD5 或 SignTypeHMACSHA256，不填默认 SignTypeMD5
+	NotifyStore NotifyStore // HandleNotify/HandleRefundNotify 用以去重的存储，不填默认使用内存 LRU
+	Transport   *Transport  // 控制重试/超时/主备域名切换，不填默认使用 defaultTransport
+
+	certPEM, keyPEM []byte
+	certOnce        sync.Once
+	certClient      *http.Client
+	certErr         error
+
+	notifyStoreOnce sync.Once
+}
+
+// Option 用于定制 NewPay 创建出的 Pay 实例
+type Option func(*Pay)
+
+// WithMerchantCert 为 Pay 配置商户证书，Refund、Reverse 等要求双向 TLS 认证的接口
+// 会在首次用到证书时才用它惰性构建 *http.Client，经 transport().post 传入覆盖默认 Client
+func WithMerchantCert(certPEM, keyPEM []byte) Option {
+	return func(p *Pay) {
+		p.certPEM = certPEM
+		p.keyPEM = keyPEM
+	}
+}
+
+// secureClient 惰性构建并返回携带商户证书的 *http.Client
+func (pcf *Pay) secureClient() (*http.Client, error) {
+	pcf.certOnce.Do(func() {
+		if pcf.certPEM == nil || pcf.keyPEM == nil {
+			pcf.certErr = errors.New("[msg : missingMerchantCert] 该接口需要 WithMerchantCert 配置的商户证书")
+			return
+		}
+		cert, err := tls.X509KeyPair(pcf.certPEM, pcf.keyPEM)
+		if err != nil {
+			pcf.certErr = err
+			return
+		}
+		pcf.certClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+			},
+		}
+	})
+	return pcf.certClient, pcf.certErr
 }
 
 // UnifiedorderParams was NEEDED when request unifiedorder
@@ -33,6 +76,11 @@ type UnifiedorderParams struct {
 	OutTradeNo   string // 商户订单号码，唯一
 	OpenID       string // openid 收取获取
 	PayNotifyURL string //通知地址
+
+	TradeType string // 交易类型 JSAPI/NATIVE/APP/MWEB/MICROPAY，不填默认 JSAPI
+	ProductID string // NATIVE 下单必填，商户侧商品ID
+	SceneInfo string // MWEB 下单必填，已序列化为 JSON 的场景信息，如 {"h5_info":{"type":"Wap","wap_url":"...","wap_name":"..."}}
+	LimitPay  string // 指定不能使用的支付方式，如 no_credit
 }
 
 // JSAPIParams 是传出用于 JSAPIConfig 用的参数
@@ -57,11 +105,12 @@ type payResult struct {
 	TradeType  string `xml:"trade_type,omitempty"`
 	PrePayID   string `xml:"prepay_id,omitempty"`
 	CodeURL    string `xml:"code_url,omitempty"`
+	MWebURL    string `xml:"mweb_url,omitempty"`
 	ErrCode    string `xml:"err_code,omitempty"`
 	ErrCodeDes string `xml:"err_code_des,omitempty"`
 }
 
-//payRequest 接口请求参数
+// payRequest 接口请求参数
 type payRequest struct {
 	AppID          string `xml:"appid"`
 	MchID          string `xml:"mch_id"`
@@ -111,6 +160,7 @@ type OrderQueryResult struct {
 
 	AppID      string `xml:"appid,omitempty"`        // 微信分配的公众账号ID
 	MchID      string `xml:"mch_id,omitempty"`       // 微信支付分配的商户号
+	SignType   string `xml:"sign_type,omitempty"`    // 签名类型，HMAC-SHA256 或 MD5
 	NonceStr   string `xml:"nonce_str,omitempty"`    // 随机字符串，不长于32位。推荐随机数生成算法
 	Sign       string `xml:"sign,omitempty"`         // 签名，详见签名生成算法
 	ResultCode string `xml:"result_code,omitempty"`  // SUCCESS/FAIL
@@ -136,26 +186,61 @@ type OrderQueryResult struct {
 	Attach             string `xml:"attach,omitempty"`               // 深圳分店	附加数据，原样返回
 	TradeStateDesc     string `xml:"trade_state_desc,omitempty"`     // 对当前查询订单状态的描述和下一步操作的指引
 	TimeEnd            string `xml:"time_end,omitempty"`             // 交易结束时间
+
+	raw []byte // 原始响应报文，供 CheckSign 重建签名串；未导出字段，xml.Unmarshal 不会触碰它
 }
 
 // NewPay return an instance of Pay package
-func NewPay(ctx *context.Context) *Pay {
+func NewPay(ctx *context.Context, opts ...Option) *Pay {
 	pay := Pay{Context: ctx}
+	for _, opt := range opts {
+		opt(&pay)
+	}
 	return &pay
 }
 
 // PrePayID will request wechat merchant api and request for a pre payment order id
 func (pcf *Pay) PrePayID(p *UnifiedorderParams) (prePayID string, err error) {
+	ret, err := pcf.unifiedOrder(p)
+	if err != nil {
+		return "", err
+	}
+	return ret.PrePayID, nil
+}
+
+// unifiedOrder 发起统一下单，返回完整的接口结果。PrePayID 只需要 prepay_id，
+// 而 NativeOrder/H5Order 等还需要 code_url/mweb_url，因此都复用这一个内部方法
+func (pcf *Pay) unifiedOrder(p *UnifiedorderParams) (*payResult, error) {
 	nonceStr := util.RandomStr(32)
-	tradeType := "JSAPI"
-	template := "appid=%s&body=%s&fee_type=%s&mch_id=%s&nonce_str=%s&notify_url=%s&openid=%s&out_trade_no=%s&spbill_create_ip=%s&total_fee=%s&trade_type=%s&key=%s"
-	str := fmt.Sprintf(template, pcf.AppID, p.Body, p.FeeType, pcf.PayMchID, nonceStr, pcf.PayNotifyURL, p.OpenID, p.OutTradeNo, p.CreateIP, p.TotalFee, tradeType, pcf.PayKey)
-	sign := util.MD5Sum(str)
+	tradeType := p.TradeType
+	if tradeType == "" {
+		tradeType = "JSAPI"
+	}
+	signType := pcf.signType()
+	fields := map[string]string{
+		"appid":            pcf.AppID,
+		"mch_id":           pcf.PayMchID,
+		"nonce_str":        nonceStr,
+		"sign_type":        signType,
+		"body":             p.Body,
+		"fee_type":         p.FeeType,
+		"notify_url":       pcf.PayNotifyURL,
+		"openid":           p.OpenID,
+		"out_trade_no":     p.OutTradeNo,
+		"spbill_create_ip": p.CreateIP,
+		"total_fee":        p.TotalFee,
+		"trade_type":       tradeType,
+		"product_id":       p.ProductID,
+		"scene_info":       p.SceneInfo,
+		"limit_pay":        p.LimitPay,
+	}
+	sign := Sign(fields, pcf.PayKey, signType)
 	request := payRequest{
 		AppID:          pcf.AppID,
 		MchID:          pcf.PayMchID,
 		NonceStr:       nonceStr,
 		Sign:           sign,
+		SignType:       signType,
 		Body:           p.Body,
 		OutTradeNo:     p.OutTradeNo,
 		FeeType:        p.FeeType,
@@ -164,24 +249,25 @@ func (pcf *Pay) PrePayID(p *UnifiedorderParams) (prePayID string, err error) {
 		NotifyURL:      pcf.PayNotifyURL,
 		TradeType:      tradeType,
 		OpenID:         p.OpenID,
+		ProductID:      p.ProductID,
+		SceneInfo:      p.SceneInfo,
+		LimitPay:       p.LimitPay,
 	}
-	rawRet, err := util.PostXML(payGateway, request)
+	rawRet, err := pcf.transport().Post(unifiedorderPath, request)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	payRet := payResult{}
-	err = xml.Unmarshal(rawRet, &payRet)
-	if err != nil {
-		return "", err
+	if err := xml.Unmarshal(rawRet, &payRet); err != nil {
+		return nil, err
 	}
-	if payRet.ReturnCode == "SUCCESS" {
-		//pay success
-		if payRet.ResultCode == "SUCCESS" {
-			return payRet.PrePayID, nil
-		}
-		return "", errors.New(payRet.ErrCode + payRet.ErrCodeDes)
+	if payRet.ReturnCode != "SUCCESS" {
+		return nil, errors.New("[msg : xmlUnmarshalError] [rawReturn : " + string(rawRet) + "] [sign : " + sign + "]")
 	}
-	return "", errors.New("[msg : xmlUnmarshalError] [rawReturn : " + string(rawRet) + "] [params : " + str + "] [sign : " + sign + "]")
+	if payRet.ResultCode != "SUCCESS" {
+		return nil, errors.New(payRet.ErrCode + payRet.ErrCodeDes)
+	}
+	return &payRet, nil
 }
 
 // GetJSAPI 配置文件
@@ -193,12 +279,16 @@ func (pcf *Pay) GetJSAPI(p *UnifiedorderParams) (*JSAPIParams, error) {
 	}
 
 	pkg := "prepay_id=" + prePayID
-	signType := "MD5"
+	signType := pcf.signType()
 	t := time.Now().Unix()
 	timeStr := strconv.FormatInt(t, 10)
-	template := "appId=%s&nonceStr=%s&package=%s&signType=%s&timeStamp=%s&key=%s"
-	str := fmt.Sprintf(template, pcf.AppID, nonceStr, pkg, signType, timeStr, pcf.PayKey)
-	sign := util.MD5Sum(str)
+	sign := Sign(map[string]string{
+		"appId":     pcf.AppID,
+		"nonceStr":  nonceStr,
+		"package":   pkg,
+		"signType":  signType,
+		"timeStamp": timeStr,
+	}, pcf.PayKey, signType)
 	var jp JSAPIParams
 	jp.AppID = pcf.AppID
 	jp.Timestamp = t
@@ -212,76 +302,61 @@ func (pcf *Pay) GetJSAPI(p *UnifiedorderParams) (*JSAPIParams, error) {
 // OrderQuery 查询订单结果 自己判断 TradeState 是否成功
 func (pcf *Pay) OrderQuery(outTradeNo string) (*OrderQueryResult, error) {
 	nonceStr := util.RandomStr(32)
-	template := "appid=%s&mch_id=%s&nonce_str=%s&out_trade_no=%s&key=%s"
-	str := fmt.Sprintf(template, pcf.AppID, pcf.PayMchID, nonceStr, outTradeNo, pcf.PayKey)
-	sign := util.MD5Sum(str)
+	signType := pcf.signType()
+	sign := Sign(map[string]string{
+		"appid":        pcf.AppID,
+		"mch_id":       pcf.PayMchID,
+		"nonce_str":    nonceStr,
+		"sign_type":    signType,
+		"out_trade_no": outTradeNo,
+	}, pcf.PayKey, signType)
 	request := OrderQueryRequest{
 		AppID:      pcf.AppID,
 		MchID:      pcf.PayMchID,
 		OutTradeNo: outTradeNo,
 		NonceStr:   nonceStr,
 		Sign:       sign,
+		SignType:   signType,
 	}
-	rawRet, err := util.PostXML(orderQueryURI, request)
-	if err != nil {
-		// 失败了 使用备用接口再次查询
-		rawRet, err := util.PostXML(orderQueryURI2, request)
-		if err != nil {
-			return nil, err
-		}
-		oqr, err := rawOrderQuery(rawRet, str, sign)
-		if err != nil {
-			return nil, err
-		}
-		return oqr, err
-
-	}
-	oqr, err := rawOrderQuery(rawRet, str, sign)
+	rawRet, err := pcf.transport().Post(orderQueryPath, request)
 	if err != nil {
 		return nil, err
 	}
-	return oqr, err
+	return rawOrderQuery(rawRet, sign)
 }
 
 // OrderMchQuery 查询订单结果 自己判断 TradeState 是否成功
 func (pcf *Pay) OrderMchQuery(TransactionID string) (*OrderQueryResult, error) {
 	nonceStr := util.RandomStr(32)
-	template := "appid=%s&mch_id=%s&nonce_str=%s&transaction_id=%s&key=%s"
-	str := fmt.Sprintf(template, pcf.AppID, pcf.PayMchID, nonceStr, TransactionID, pcf.PayKey)
-	sign := util.MD5Sum(str)
+	signType := pcf.signType()
+	sign := Sign(map[string]string{
+		"appid":          pcf.AppID,
+		"mch_id":         pcf.PayMchID,
+		"nonce_str":      nonceStr,
+		"sign_type":      signType,
+		"transaction_id": TransactionID,
+	}, pcf.PayKey, signType)
 	request := OrderQueryRequest{
 		AppID:         pcf.AppID,
 		MchID:         pcf.PayMchID,
 		TransactionID: TransactionID,
 		NonceStr:      nonceStr,
 		Sign:          sign,
+		SignType:      signType,
 	}
-	rawRet, err := util.PostXML(orderQueryURI, request)
-	if err != nil {
-		// 失败了 使用备用接口再次查询
-		rawRet, err := util.PostXML(orderQueryURI2, request)
-		if err != nil {
-			return nil, err
-		}
-		oqr, err := rawOrderQuery(rawRet, str, sign)
-		if err != nil {
-			return nil, err
-		}
-		return oqr, err
-
-	}
-	oqr, err := rawOrderQuery(rawRet, str, sign)
+	rawRet, err := pcf.transport().Post(orderQueryPath, request)
 	if err != nil {
 		return nil, err
 	}
-	return oqr, err
+	return rawOrderQuery(rawRet, sign)
 }
-func rawOrderQuery(rawRet []byte, str, sign string) (*OrderQueryResult, error) {
+func rawOrderQuery(rawRet []byte, sign string) (*OrderQueryResult, error) {
 	oqrRet := OrderQueryResult{}
 	err := xml.Unmarshal(rawRet, &oqrRet)
 	if err != nil {
 		return nil, err
 	}
+	oqrRet.raw = rawRet
 	if oqrRet.ReturnCode == "SUCCESS" {
 		if oqrRet.ResultCode == "SUCCESS" {
 			// if oqrRet.TradeState == "SUCCESS" {
@@ -291,7 +366,7 @@ func rawOrderQuery(rawRet []byte, str, sign string) (*OrderQueryResult, error) {
 		}
 		return nil, errors.New(oqrRet.ErrCode + oqrRet.ErrCodeDes)
 	}
-	return nil, errors.New("[msg : xmlUnmarshalError] [rawReturn : " + string(rawRet) + "] [signstr : " + str + "] [sign : " + sign + "]")
+	return nil, errors.New("[msg : xmlUnmarshalError] [rawReturn : " + string(rawRet) + "] [sign : " + sign + "]")
 }
 
 // NotifyInfo 解码微信的通知信息 并验证权限
@@ -305,6 +380,7 @@ func (pcf *Pay) NotifyInfo(req *http.Request) (*OrderQueryResult, error) {
 	if err != nil {
 		return nil, err
 	}
+	oqrRet.raw = reqByte
 	if oqrRet.ReturnCode == "SUCCESS" {
 		if oqrRet.ResultCode == "SUCCESS" {
 			return &oqrRet, nil
@@ -315,34 +391,26 @@ func (pcf *Pay) NotifyInfo(req *http.Request) (*OrderQueryResult, error) {
 
 }
 
-// CheckSign 检查签名
-func (pcf *Pay) CheckSign(or *OrderQueryResult, p *UnifiedorderParams) error {
-	// appid=%s&mch_id=%s&result_code=%s&openid=%s&is_subscribe=%s&trade_type=%s&bank_type=%s&total_fee=%s&cash_fee=%s&transaction_id=%s&out_trade_no=%s&time_end=%s
-	tmp := []string{
-		"appid=" + pcf.AppID + "&",
-		"mch_id=" + pcf.PayMchID + "&",
-		"result_code=" + or.ResultCode + "&",
-		"openid=" + p.OpenID + "&",
-		"is_subscribe=" + or.IsSubscribe + "&",
-		"trade_type=" + or.TradeType + "&",
-		"bank_type=" + or.BankType + "&",
-		"total_fee=" + p.TotalFee + "&",
-		"cash_fee=" + strconv.Itoa(or.CashFee) + "&",
-		"transaction_id=" + or.TransactionID + "&",
-		"out_trade_no=" + p.OutTradeNo + "&",
-		"time_end=" + or.TimeEnd + "&",
-		"return_code=" + or.ReturnCode + "&",
-		"return_msg=" + or.ReturnMsg + "&",
-		"nonce_str=" + or.NonceStr + "&",
+// CheckSign 校验 or 的签名，or 必须来自 OrderQuery/OrderMchQuery/NotifyInfo（它们在
+// 解析响应时顺带保留了原始报文）。必须基于原始报文重建签名串，而不是反射 OrderQueryResult
+// 的字段——coupon_id_0、coupon_type_0、coupon_fee_0、promotion_detail 等字段不在
+// OrderQueryResult 里，一旦只依赖已解析的结构体，这些字段就已经丢失，恰好是带优惠券的
+// 订单必然验签失败
+func (pcf *Pay) CheckSign(or *OrderQueryResult) error {
+	if len(or.raw) == 0 {
+		return errors.New("[msg : missingRawXML] or 不是由 OrderQuery/OrderMchQuery/NotifyInfo 返回的")
+	}
+	var fields xmlFields
+	if err := xml.Unmarshal(or.raw, &fields); err != nil {
+		return err
 	}
-	sort.Strings(tmp)
-	var str string
-	for _, v := range tmp {
-		str += v
+	signType := fields["sign_type"]
+	if signType == "" {
+		signType = pcf.signType()
 	}
-	sign := util.MD5Sum(str)
-	if sign == or.Sign {
-		return nil
+	gotSign := fields["sign"]
+	if gotSign == "" || Sign(fields, pcf.PayKey, signType) != gotSign {
+		return errors.New("签名错误")
 	}
-	return errors.New("签名错误")
+	return nil
 }
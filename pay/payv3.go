@@ -0,0 +1,498 @@
+package pay
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aimo-x/wechat/context"
+	"github.com/aimo-x/wechat/util"
+)
+
+// apiV3Host 是 APIv3 网关域名，XML 网关的主备域名切换由 transport.go 中的 Transport 负责
+const apiV3Host = "https://api.mch.weixin.qq.com"
+
+// PayV3 是 APIv3（JSON + RSA-SHA256）商户支付客户端，与基于 XML+MD5 的 Pay 并行存在，
+// 二者共享 context.Context 中的商户基础信息，但签名、加解密方式完全不同
+type PayV3 struct {
+	*context.Context
+
+	mchID      string
+	serialNo   string // 商户API证书序列号
+	privateKey *rsa.PrivateKey
+	apiV3Key   []byte
+
+	client *http.Client
+
+	certMu sync.RWMutex
+	certs  map[string]*rsa.PublicKey // 平台证书序列号 -> 公钥，用于验签
+}
+
+// apiError 是 APIv3 网关返回的标准错误体
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("[code : %s] [message : %s]", e.Code, e.Message)
+}
+
+// Transaction 是 APIv3 支付通知及查单接口共用的交易资源
+type Transaction struct {
+	AppID           string       `json:"appid"`
+	MchID           string       `json:"mchid"`
+	OutTradeNo      string       `json:"out_trade_no"`
+	TransactionID   string       `json:"transaction_id,omitempty"`
+	TradeType       string       `json:"trade_type,omitempty"`
+	TradeState      string       `json:"trade_state"`
+	TradeStateDesc  string       `json:"trade_state_desc,omitempty"`
+	BankType        string       `json:"bank_type,omitempty"`
+	Attach          string       `json:"attach,omitempty"`
+	SuccessTime     string       `json:"success_time,omitempty"`
+	Payer           *PayerInfo   `json:"payer,omitempty"`
+	Amount          *AmountInfo  `json:"amount,omitempty"`
+	SceneInfo       *SceneInfoV3 `json:"scene_info,omitempty"`
+	PromotionDetail []Promotion  `json:"promotion_detail,omitempty"`
+}
+
+// PayerInfo 是支付者信息
+type PayerInfo struct {
+	OpenID string `json:"openid"`
+}
+
+// AmountInfo 是订单金额信息
+type AmountInfo struct {
+	Total         int    `json:"total"`
+	PayerTotal    int    `json:"payer_total,omitempty"`
+	Currency      string `json:"currency,omitempty"`
+	PayerCurrency string `json:"payer_currency,omitempty"`
+}
+
+// SceneInfoV3 是 APIv3 场景信息，APIv2 的 scene_info 为手填 JSON 字符串，APIv3 为结构化字段
+type SceneInfoV3 struct {
+	PayerClientIP string `json:"payer_client_ip"`
+	DeviceID      string `json:"device_id,omitempty"`
+}
+
+// Promotion 是代金券/优惠信息
+type Promotion struct {
+	CouponID            string `json:"coupon_id"`
+	Name                string `json:"name,omitempty"`
+	Amount              int    `json:"amount"`
+	WechatpayContribute int    `json:"wechatpay_contribute,omitempty"`
+}
+
+// PrepayParamsV3 是 JSAPI/APP/Native/H5 统一下单共用的请求参数
+type PrepayParamsV3 struct {
+	Description string
+	OutTradeNo  string
+	NotifyURL   string
+	TotalFee    int    // 订单总金额，单位为分
+	Currency    string // 默认 CNY
+	OpenID      string // JSAPI 必填
+	ClientIP    string // H5 必填，终端IP；只有 H5Prepay 使用，其他下单方式不发送该字段
+	Attach      string
+}
+
+// NewPayV3 创建一个基于 APIv3 的支付客户端
+// merchantSerialNo 是商户API证书序列号，privateKeyPEM 是商户API私钥（PEM 格式），apiV3Key 是 APIv3 密钥（32字节）
+func NewPayV3(ctx *context.Context, merchantSerialNo string, privateKeyPEM []byte, apiV3Key string) (*PayV3, error) {
+	block, _ := pem.Decode(privateKeyPEM)
+	if block == nil {
+		return nil, errors.New("[msg : invalid privateKeyPEM] 无法解析商户API私钥")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("[msg : invalid privateKeyPEM] 商户API私钥必须是 RSA 私钥")
+	}
+	if len(apiV3Key) != 32 {
+		return nil, errors.New("[msg : invalid apiV3Key] APIv3密钥长度必须为32字节")
+	}
+	return &PayV3{
+		Context:    ctx,
+		mchID:      ctx.PayMchID,
+		serialNo:   merchantSerialNo,
+		privateKey: rsaKey,
+		apiV3Key:   []byte(apiV3Key),
+		client:     http.DefaultClient,
+		certs:      make(map[string]*rsa.PublicKey),
+	}, nil
+}
+
+// sign 按 METHOD\nURI\nTIMESTAMP\nNONCE\nBODY\n 构造待签名串，并使用商户私钥 RSA-SHA256 签名
+func (p *PayV3) sign(method, uri, timestamp, nonce, body string) (string, error) {
+	message := fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n", method, uri, timestamp, nonce, body)
+	digest := sha256.Sum256([]byte(message))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+// authorization 生成 Authorization 头
+func (p *PayV3) authorization(method, uri, body string) (string, error) {
+	nonce := util.RandomStr(32)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sig, err := p.sign(method, uri, timestamp, nonce, body)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(
+		`WECHATPAY2-SHA256-RSA2048 mchid="%s",nonce_str="%s",timestamp="%s",serial_no="%s",signature="%s"`,
+		p.mchID, nonce, timestamp, p.serialNo, sig,
+	), nil
+}
+
+// request 向 APIv3 网关发起请求，校验返回的 Wechatpay-Signature 后返回响应体
+func (p *PayV3) request(method, path string, payload interface{}) ([]byte, error) {
+	var body []byte
+	var err error
+	if payload != nil {
+		body, err = json.Marshal(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+	auth, err := p.authorization(method, path, string(body))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, apiV3Host+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "wechat-pay-go/v3")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// 证书接口本身不需要用缓存的证书验签（首次调用时缓存为空），但仍建议尽早拉取证书
+	if path != "/v3/certificates" {
+		if err := p.verify(resp.Header, respBody); err != nil {
+			return nil, err
+		}
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return respBody, nil
+	}
+	apiErr := apiError{}
+	if err := json.Unmarshal(respBody, &apiErr); err != nil {
+		return nil, fmt.Errorf("[msg : httpError] [status : %d] [body : %s]", resp.StatusCode, string(respBody))
+	}
+	return nil, &apiErr
+}
+
+// verify 校验 Wechatpay-Signature，待验签串为 Wechatpay-Timestamp\nWechatpay-Nonce\nBody\n
+func (p *PayV3) verify(header http.Header, body []byte) error {
+	serial := header.Get("Wechatpay-Serial")
+	signature := header.Get("Wechatpay-Signature")
+	timestamp := header.Get("Wechatpay-Timestamp")
+	nonce := header.Get("Wechatpay-Nonce")
+	if serial == "" || signature == "" {
+		return errors.New("[msg : missingSignatureHeader] 响应缺少签名头")
+	}
+	pub, err := p.platformPublicKey(serial)
+	if err != nil {
+		return err
+	}
+	message := fmt.Sprintf("%s\n%s\n%s\n", timestamp, nonce, string(body))
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(message))
+	return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig)
+}
+
+// platformPublicKey 返回指定序列号的平台证书公钥，缓存未命中时自动拉取并刷新证书列表
+func (p *PayV3) platformPublicKey(serial string) (*rsa.PublicKey, error) {
+	p.certMu.RLock()
+	pub, ok := p.certs[serial]
+	p.certMu.RUnlock()
+	if ok {
+		return pub, nil
+	}
+	if err := p.fetchCertificates(); err != nil {
+		return nil, err
+	}
+	p.certMu.RLock()
+	defer p.certMu.RUnlock()
+	pub, ok = p.certs[serial]
+	if !ok {
+		return nil, fmt.Errorf("[msg : unknownPlatformCert] [serial : %s]", serial)
+	}
+	return pub, nil
+}
+
+type encryptedCertificate struct {
+	Algorithm      string `json:"algorithm"`
+	Nonce          string `json:"nonce"`
+	AssociatedData string `json:"associated_data"`
+	Ciphertext     string `json:"ciphertext"`
+}
+
+type platformCertificate struct {
+	SerialNo           string               `json:"serial_no"`
+	EffectiveTime      string               `json:"effective_time"`
+	ExpireTime         string               `json:"expire_time"`
+	EncryptCertificate encryptedCertificate `json:"encrypt_certificate"`
+}
+
+type certificatesResult struct {
+	Data []platformCertificate `json:"data"`
+}
+
+// fetchCertificates 拉取并解密微信支付平台证书，更新本地缓存
+func (p *PayV3) fetchCertificates() error {
+	raw, err := p.request(http.MethodGet, "/v3/certificates", nil)
+	if err != nil {
+		return err
+	}
+	var result certificatesResult
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return err
+	}
+	certs := make(map[string]*rsa.PublicKey, len(result.Data))
+	for _, c := range result.Data {
+		plain, err := p.decryptCertificate(c.EncryptCertificate)
+		if err != nil {
+			return err
+		}
+		block, _ := pem.Decode(plain)
+		if block == nil {
+			return errors.New("[msg : invalidPlatformCert] 无法解析平台证书")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		pub, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("[msg : invalidPlatformCert] 平台证书公钥类型错误")
+		}
+		certs[c.SerialNo] = pub
+	}
+	p.certMu.Lock()
+	for serial, pub := range certs {
+		p.certs[serial] = pub
+	}
+	p.certMu.Unlock()
+	return nil
+}
+
+// decryptCertificate 使用 APIv3 密钥 AEAD_AES_256_GCM 解密 encrypt_certificate
+func (p *PayV3) decryptCertificate(c encryptedCertificate) ([]byte, error) {
+	return decryptAEADAES256GCM(p.apiV3Key, c.Nonce, c.AssociatedData, c.Ciphertext)
+}
+
+// decryptAEADAES256GCM 解密 resource/encrypt_certificate 等使用 AEAD_AES_256_GCM 加密的字段
+func decryptAEADAES256GCM(key []byte, nonce, associatedData, ciphertextB64 string) ([]byte, error) {
+	ciphertext, err := base64.StdEncoding.DecodeString(ciphertextB64)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("[msg : invalidNonce] [want : %d] [got : %d]", gcm.NonceSize(), len(nonce))
+	}
+	return gcm.Open(nil, []byte(nonce), ciphertext, []byte(associatedData))
+}
+
+// JSAPIPrepay 发起 JSAPI 下单，返回 prepay_id
+func (p *PayV3) JSAPIPrepay(params *PrepayParamsV3) (string, error) {
+	if params.OpenID == "" {
+		return "", errors.New("[msg : missingOpenID] JSAPI下单需要 OpenID")
+	}
+	req := p.buildPrepayRequest("JSAPI", params)
+	req["payer"] = map[string]string{"openid": params.OpenID}
+	return p.prepay("/v3/pay/transactions/jsapi", req)
+}
+
+// AppPrepay 发起 APP 下单，返回 prepay_id
+func (p *PayV3) AppPrepay(params *PrepayParamsV3) (string, error) {
+	req := p.buildPrepayRequest("APP", params)
+	return p.prepay("/v3/pay/transactions/app", req)
+}
+
+// NativePrepay 发起 Native（扫码）下单，返回用于生成二维码的 code_url
+func (p *PayV3) NativePrepay(params *PrepayParamsV3) (string, error) {
+	req := p.buildPrepayRequest("NATIVE", params)
+	raw, err := p.request(http.MethodPost, "/v3/pay/transactions/native", req)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		CodeURL string `json:"code_url"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return "", err
+	}
+	return result.CodeURL, nil
+}
+
+// H5Prepay 发起 H5/MWEB 下单，返回用于跳转拉起支付的 h5_url
+func (p *PayV3) H5Prepay(params *PrepayParamsV3) (string, error) {
+	if params.ClientIP == "" {
+		return "", errors.New("[msg : missingClientIP] H5下单需要 ClientIP")
+	}
+	req := p.buildPrepayRequest("MWEB", params)
+	req["scene_info"] = map[string]interface{}{
+		"payer_client_ip": params.ClientIP,
+	}
+	raw, err := p.request(http.MethodPost, "/v3/pay/transactions/h5", req)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		H5URL string `json:"h5_url"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return "", err
+	}
+	return result.H5URL, nil
+}
+
+func (p *PayV3) buildPrepayRequest(tradeType string, params *PrepayParamsV3) map[string]interface{} {
+	currency := params.Currency
+	if currency == "" {
+		currency = "CNY"
+	}
+	req := map[string]interface{}{
+		"appid":        p.AppID,
+		"mchid":        p.mchID,
+		"description":  params.Description,
+		"out_trade_no": params.OutTradeNo,
+		"notify_url":   params.NotifyURL,
+		"amount": map[string]interface{}{
+			"total":    params.TotalFee,
+			"currency": currency,
+		},
+	}
+	if params.Attach != "" {
+		req["attach"] = params.Attach
+	}
+	_ = tradeType // trade type is implied by the endpoint path for APIv3
+	return req
+}
+
+func (p *PayV3) prepay(path string, req map[string]interface{}) (string, error) {
+	raw, err := p.request(http.MethodPost, path, req)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		PrepayID string `json:"prepay_id"`
+	}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return "", err
+	}
+	return result.PrepayID, nil
+}
+
+// QueryByTransactionID 以微信订单号查询交易
+func (p *PayV3) QueryByTransactionID(transactionID string) (*Transaction, error) {
+	path := fmt.Sprintf("/v3/pay/transactions/id/%s?mchid=%s", transactionID, p.mchID)
+	return p.queryTransaction(path)
+}
+
+// QueryByOutTradeNo 以商户订单号查询交易
+func (p *PayV3) QueryByOutTradeNo(outTradeNo string) (*Transaction, error) {
+	path := fmt.Sprintf("/v3/pay/transactions/out-trade-no/%s?mchid=%s", outTradeNo, p.mchID)
+	return p.queryTransaction(path)
+}
+
+func (p *PayV3) queryTransaction(path string) (*Transaction, error) {
+	raw, err := p.request(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	var t Transaction
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// CloseOrder 关闭一笔尚未支付的 APIv3 订单
+func (p *PayV3) CloseOrder(outTradeNo string) error {
+	path := fmt.Sprintf("/v3/pay/transactions/out-trade-no/%s/close", outTradeNo)
+	_, err := p.request(http.MethodPost, path, map[string]string{"mchid": p.mchID})
+	return err
+}
+
+// notifyEnvelope 是 APIv3 回调通知的外层信封
+type notifyEnvelope struct {
+	ID           string         `json:"id"`
+	EventType    string         `json:"event_type"`
+	ResourceType string         `json:"resource_type"`
+	Resource     notifyResource `json:"resource"`
+}
+
+type notifyResource struct {
+	Algorithm      string `json:"algorithm"`
+	Nonce          string `json:"nonce"`
+	AssociatedData string `json:"associated_data"`
+	Ciphertext     string `json:"ciphertext"`
+}
+
+// DecryptNotify 验签并解密 APIv3 支付回调通知，返回解密后的交易资源
+func (p *PayV3) DecryptNotify(req *http.Request) (*Transaction, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.verify(req.Header, body); err != nil {
+		return nil, err
+	}
+	var envelope notifyEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+	plain, err := decryptAEADAES256GCM(p.apiV3Key, envelope.Resource.Nonce, envelope.Resource.AssociatedData, envelope.Resource.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	var t Transaction
+	if err := json.Unmarshal(plain, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,439 @@
+package pay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"errors"
+	"strings"
+
+	"github.com/aimo-x/wechat/util"
+)
+
+const (
+	refundPath           = "/secapi/pay/refund"
+	refundQueryPath      = "/pay/refundquery"
+	closeOrderPath       = "/pay/closeorder"
+	reversePath          = "/secapi/pay/reverse"
+	downloadBillPath     = "/pay/downloadbill"
+	downloadFundFlowPath = "/pay/downloadfundflow"
+)
+
+// RefundParams 是发起退款需要传入的参数，TransactionID 和 OutTradeNo 二选一
+type RefundParams struct {
+	TransactionID string
+	OutTradeNo    string
+	OutRefundNo   string // 商户退款单号，同一笔订单多次退款需要保证唯一
+	TotalFee      string // 订单总金额，单位为分
+	RefundFee     string // 退款金额，单位为分
+	RefundFeeType string // 货币种类，默认 CNY
+	RefundDesc    string // 退款原因
+	NotifyURL     string // 退款结果通知地址
+}
+
+type refundRequest struct {
+	AppID         string `xml:"appid"`
+	MchID         string `xml:"mch_id"`
+	NonceStr      string `xml:"nonce_str"`
+	Sign          string `xml:"sign"`
+	SignType      string `xml:"sign_type,omitempty"`
+	TransactionID string `xml:"transaction_id,omitempty"`
+	OutTradeNo    string `xml:"out_trade_no,omitempty"`
+	OutRefundNo   string `xml:"out_refund_no"`
+	TotalFee      string `xml:"total_fee"`
+	RefundFee     string `xml:"refund_fee"`
+	RefundFeeType string `xml:"refund_fee_type,omitempty"`
+	RefundDesc    string `xml:"refund_desc,omitempty"`
+	NotifyURL     string `xml:"notify_url,omitempty"`
+}
+
+// RefundResult 是退款申请接口的返回结果
+type RefundResult struct {
+	ReturnCode string `xml:"return_code"`
+	ReturnMsg  string `xml:"return_msg"`
+
+	AppID      string `xml:"appid,omitempty"`
+	MchID      string `xml:"mch_id,omitempty"`
+	NonceStr   string `xml:"nonce_str,omitempty"`
+	Sign       string `xml:"sign,omitempty"`
+	ResultCode string `xml:"result_code,omitempty"`
+	ErrCode    string `xml:"err_code,omitempty"`
+	ErrCodeDes string `xml:"err_code_des,omitempty"`
+
+	TransactionID       string `xml:"transaction_id,omitempty"`
+	OutTradeNo          string `xml:"out_trade_no,omitempty"`
+	OutRefundNo         string `xml:"out_refund_no,omitempty"`
+	RefundID            string `xml:"refund_id,omitempty"`
+	RefundFee           int    `xml:"refund_fee,omitempty"`
+	SettlementRefundFee int    `xml:"settlement_refund_fee,omitempty"`
+	TotalFee            int    `xml:"total_fee,omitempty"`
+	CashFee             int    `xml:"cash_fee,omitempty"`
+	CashRefundFee       int    `xml:"cash_refund_fee,omitempty"`
+}
+
+// Refund 申请退款，要求商户已通过 WithMerchantCert 配置证书
+func (pcf *Pay) Refund(p *RefundParams) (*RefundResult, error) {
+	client, err := pcf.secureClient()
+	if err != nil {
+		return nil, err
+	}
+	nonceStr := util.RandomStr(32)
+	signType := pcf.signType()
+	sign := Sign(map[string]string{
+		"appid":           pcf.AppID,
+		"mch_id":          pcf.PayMchID,
+		"nonce_str":       nonceStr,
+		"sign_type":       signType,
+		"notify_url":      p.NotifyURL,
+		"out_refund_no":   p.OutRefundNo,
+		"out_trade_no":    p.OutTradeNo,
+		"refund_desc":     p.RefundDesc,
+		"refund_fee":      p.RefundFee,
+		"refund_fee_type": p.RefundFeeType,
+		"total_fee":       p.TotalFee,
+		"transaction_id":  p.TransactionID,
+	}, pcf.PayKey, signType)
+	request := refundRequest{
+		AppID:         pcf.AppID,
+		MchID:         pcf.PayMchID,
+		NonceStr:      nonceStr,
+		Sign:          sign,
+		SignType:      signType,
+		TransactionID: p.TransactionID,
+		OutTradeNo:    p.OutTradeNo,
+		OutRefundNo:   p.OutRefundNo,
+		TotalFee:      p.TotalFee,
+		RefundFee:     p.RefundFee,
+		RefundFeeType: p.RefundFeeType,
+		RefundDesc:    p.RefundDesc,
+		NotifyURL:     p.NotifyURL,
+	}
+	rawRet, err := pcf.transport().post(refundPath, request, client)
+	if err != nil {
+		return nil, err
+	}
+	ret := RefundResult{}
+	if err := xml.Unmarshal(rawRet, &ret); err != nil {
+		return nil, err
+	}
+	if ret.ReturnCode != "SUCCESS" {
+		return nil, errors.New("[msg : xmlUnmarshalError] [rawReturn : " + string(rawRet) + "]")
+	}
+	if ret.ResultCode != "SUCCESS" {
+		return nil, errors.New(ret.ErrCode + ret.ErrCodeDes)
+	}
+	return &ret, nil
+}
+
+// RefundQuery 以商户退款单号 out_refund_no 查询退款结果，不支持按 transaction_id/out_trade_no/refund_id 查询
+func (pcf *Pay) RefundQuery(outRefundNo string) (*RefundResult, error) {
+	nonceStr := util.RandomStr(32)
+	signType := pcf.signType()
+	sign := Sign(map[string]string{
+		"appid":         pcf.AppID,
+		"mch_id":        pcf.PayMchID,
+		"nonce_str":     nonceStr,
+		"sign_type":     signType,
+		"out_refund_no": outRefundNo,
+	}, pcf.PayKey, signType)
+	request := struct {
+		AppID       string `xml:"appid"`
+		MchID       string `xml:"mch_id"`
+		NonceStr    string `xml:"nonce_str"`
+		Sign        string `xml:"sign"`
+		SignType    string `xml:"sign_type,omitempty"`
+		OutRefundNo string `xml:"out_refund_no"`
+	}{pcf.AppID, pcf.PayMchID, nonceStr, sign, signType, outRefundNo}
+	rawRet, err := pcf.transport().Post(refundQueryPath, request)
+	if err != nil {
+		return nil, err
+	}
+	ret := RefundResult{}
+	if err := xml.Unmarshal(rawRet, &ret); err != nil {
+		return nil, err
+	}
+	if ret.ReturnCode != "SUCCESS" {
+		return nil, errors.New("[msg : xmlUnmarshalError] [rawReturn : " + string(rawRet) + "]")
+	}
+	if ret.ResultCode != "SUCCESS" {
+		return nil, errors.New(ret.ErrCode + ret.ErrCodeDes)
+	}
+	return &ret, nil
+}
+
+// CloseOrder 关闭一笔尚未支付的订单，订单生成后超过30分钟且未支付才可关闭
+func (pcf *Pay) CloseOrder(outTradeNo string) error {
+	nonceStr := util.RandomStr(32)
+	signType := pcf.signType()
+	sign := Sign(map[string]string{
+		"appid":        pcf.AppID,
+		"mch_id":       pcf.PayMchID,
+		"nonce_str":    nonceStr,
+		"sign_type":    signType,
+		"out_trade_no": outTradeNo,
+	}, pcf.PayKey, signType)
+	request := struct {
+		AppID      string `xml:"appid"`
+		MchID      string `xml:"mch_id"`
+		NonceStr   string `xml:"nonce_str"`
+		Sign       string `xml:"sign"`
+		SignType   string `xml:"sign_type,omitempty"`
+		OutTradeNo string `xml:"out_trade_no"`
+	}{pcf.AppID, pcf.PayMchID, nonceStr, sign, signType, outTradeNo}
+	rawRet, err := pcf.transport().Post(closeOrderPath, request)
+	if err != nil {
+		return err
+	}
+	ret := payResult{}
+	if err := xml.Unmarshal(rawRet, &ret); err != nil {
+		return err
+	}
+	if ret.ReturnCode != "SUCCESS" {
+		return errors.New("[msg : xmlUnmarshalError] [rawReturn : " + string(rawRet) + "]")
+	}
+	if ret.ResultCode != "SUCCESS" {
+		return errors.New(ret.ErrCode + ret.ErrCodeDes)
+	}
+	return nil
+}
+
+// ReverseResult 是撤销（付款码支付）接口的返回结果
+type ReverseResult struct {
+	ReturnCode string `xml:"return_code"`
+	ReturnMsg  string `xml:"return_msg"`
+
+	AppID      string `xml:"appid,omitempty"`
+	MchID      string `xml:"mch_id,omitempty"`
+	NonceStr   string `xml:"nonce_str,omitempty"`
+	Sign       string `xml:"sign,omitempty"`
+	ResultCode string `xml:"result_code,omitempty"`
+	ErrCode    string `xml:"err_code,omitempty"`
+	ErrCodeDes string `xml:"err_code_des,omitempty"`
+	Recall     string `xml:"recall,omitempty"` // Y：需要继续调用撤销 N：不需要再次调用
+}
+
+// Reverse 撤销付款码支付（Micropay）发起的订单，要求商户已通过 WithMerchantCert 配置证书
+func (pcf *Pay) Reverse(outTradeNo string) (*ReverseResult, error) {
+	client, err := pcf.secureClient()
+	if err != nil {
+		return nil, err
+	}
+	nonceStr := util.RandomStr(32)
+	signType := pcf.signType()
+	sign := Sign(map[string]string{
+		"appid":        pcf.AppID,
+		"mch_id":       pcf.PayMchID,
+		"nonce_str":    nonceStr,
+		"sign_type":    signType,
+		"out_trade_no": outTradeNo,
+	}, pcf.PayKey, signType)
+	request := struct {
+		AppID      string `xml:"appid"`
+		MchID      string `xml:"mch_id"`
+		NonceStr   string `xml:"nonce_str"`
+		Sign       string `xml:"sign"`
+		SignType   string `xml:"sign_type,omitempty"`
+		OutTradeNo string `xml:"out_trade_no"`
+	}{pcf.AppID, pcf.PayMchID, nonceStr, sign, signType, outTradeNo}
+	rawRet, err := pcf.transport().post(reversePath, request, client)
+	if err != nil {
+		return nil, err
+	}
+	ret := ReverseResult{}
+	if err := xml.Unmarshal(rawRet, &ret); err != nil {
+		return nil, err
+	}
+	if ret.ReturnCode != "SUCCESS" {
+		return nil, errors.New("[msg : xmlUnmarshalError] [rawReturn : " + string(rawRet) + "]")
+	}
+	return &ret, nil
+}
+
+// BillRow 是对账单中的一条交易明细
+type BillRow struct {
+	TradeTime       string
+	AppID           string
+	MchID           string
+	SubMchID        string
+	DeviceInfo      string
+	TransactionID   string
+	OutTradeNo      string
+	OpenID          string
+	TradeType       string
+	TradeState      string
+	BankType        string
+	Currency        string
+	TotalFee        string
+	CouponFee       string
+	RefundID        string
+	OutRefundNo     string
+	RefundFee       string
+	CouponRefundFee string
+	RefundType      string
+	RefundState     string
+	Body            string
+	Attach          string
+	PoundageFee     string
+	Rate            string
+}
+
+// DownloadBill 下载指定日期的交易账单，date 格式为 20190101，billType 为 ALL/SUCCESS/REFUND/REVOKED
+func (pcf *Pay) DownloadBill(date, billType string) ([]BillRow, error) {
+	nonceStr := util.RandomStr(32)
+	signType := pcf.signType()
+	sign := Sign(map[string]string{
+		"appid":     pcf.AppID,
+		"mch_id":    pcf.PayMchID,
+		"nonce_str": nonceStr,
+		"sign_type": signType,
+		"bill_date": date,
+		"bill_type": billType,
+	}, pcf.PayKey, signType)
+	request := struct {
+		AppID    string `xml:"appid"`
+		MchID    string `xml:"mch_id"`
+		NonceStr string `xml:"nonce_str"`
+		Sign     string `xml:"sign"`
+		SignType string `xml:"sign_type,omitempty"`
+		BillDate string `xml:"bill_date"`
+		BillType string `xml:"bill_type"`
+	}{pcf.AppID, pcf.PayMchID, nonceStr, sign, signType, date, billType}
+	rawRet, err := pcf.transport().Post(downloadBillPath, request)
+	if err != nil {
+		return nil, err
+	}
+	return parseBillCSV(rawRet)
+}
+
+// parseBillCSV 解析账单 CSV，表头行（以"交易时间"开头）和末尾以"总计"/"统计时间"开头的汇总行会被跳过
+func parseBillCSV(raw []byte) ([]BillRow, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var rows []BillRow
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "交易时间") || strings.HasPrefix(line, "总计") || strings.HasPrefix(line, "统计时间") {
+			continue
+		}
+		reader := csv.NewReader(strings.NewReader(line))
+		fields, err := reader.Read()
+		if err != nil || len(fields) < 21 {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.TrimPrefix(strings.TrimSpace(fields[i]), "`")
+		}
+		rows = append(rows, BillRow{
+			TradeTime:       fields[0],
+			AppID:           fields[1],
+			MchID:           fields[2],
+			SubMchID:        fields[3],
+			DeviceInfo:      fields[4],
+			TransactionID:   fields[5],
+			OutTradeNo:      fields[6],
+			OpenID:          fields[7],
+			TradeType:       fields[8],
+			TradeState:      fields[9],
+			BankType:        fields[10],
+			Currency:        fields[11],
+			TotalFee:        fields[12],
+			CouponFee:       fields[13],
+			RefundID:        fields[14],
+			OutRefundNo:     fields[15],
+			RefundFee:       fields[16],
+			CouponRefundFee: fields[17],
+			RefundType:      fields[18],
+			RefundState:     fields[19],
+			Body:            fields[20],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// FundFlowRow 是资金账单中的一条资金流水明细
+type FundFlowRow struct {
+	AccountingTime    string
+	TransactionID     string
+	OutTradeNo        string
+	FundFlowType      string
+	FundFlowDirection string
+	Amount            string
+	Balance           string
+	Applicant         string
+	Remark            string
+	BusinessName      string
+	Institution       string
+}
+
+// DownloadFundFlow 下载指定日期的资金账单，要求商户已通过 WithMerchantCert 配置证书，
+// accountType 为 Basic/Operation/Fees
+func (pcf *Pay) DownloadFundFlow(date, accountType string) ([]FundFlowRow, error) {
+	client, err := pcf.secureClient()
+	if err != nil {
+		return nil, err
+	}
+	nonceStr := util.RandomStr(32)
+	signType := SignTypeHMACSHA256
+	sign := Sign(map[string]string{
+		"appid":        pcf.AppID,
+		"mch_id":       pcf.PayMchID,
+		"nonce_str":    nonceStr,
+		"sign_type":    signType,
+		"bill_date":    date,
+		"account_type": accountType,
+	}, pcf.PayKey, signType)
+	request := struct {
+		AppID       string `xml:"appid"`
+		MchID       string `xml:"mch_id"`
+		NonceStr    string `xml:"nonce_str"`
+		Sign        string `xml:"sign"`
+		SignType    string `xml:"sign_type"`
+		BillDate    string `xml:"bill_date"`
+		AccountType string `xml:"account_type"`
+	}{pcf.AppID, pcf.PayMchID, nonceStr, sign, signType, date, accountType}
+	rawRet, err := pcf.transport().post(downloadFundFlowPath, request, client)
+	if err != nil {
+		return nil, err
+	}
+	return parseFundFlowCSV(rawRet)
+}
+
+// parseFundFlowCSV 解析资金账单 CSV，账单最后以"资金流水总笔数"开头的汇总行会被跳过
+func parseFundFlowCSV(raw []byte) ([]FundFlowRow, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	var rows []FundFlowRow
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "资金流水总笔数") || strings.HasPrefix(line, "记账时间") {
+			continue
+		}
+		reader := csv.NewReader(strings.NewReader(line))
+		fields, err := reader.Read()
+		if err != nil || len(fields) < 10 {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.TrimPrefix(strings.TrimSpace(fields[i]), "`")
+		}
+		rows = append(rows, FundFlowRow{
+			AccountingTime:    fields[0],
+			TransactionID:     fields[1],
+			OutTradeNo:        fields[2],
+			FundFlowType:      fields[3],
+			FundFlowDirection: fields[5],
+			Amount:            fields[6],
+			Balance:           fields[7],
+			Applicant:         fields[8],
+			Remark:            fields[9],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
@@ -0,0 +1,59 @@
+package pay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"github.com/aimo-x/wechat/util"
+)
+
+// SignTypeMD5、SignTypeHMACSHA256 是微信支付支持的两种签名算法，Pay.SignType 默认为 SignTypeMD5
+const (
+	SignTypeMD5        = "MD5"
+	SignTypeHMACSHA256 = "HMAC-SHA256"
+)
+
+// Sign 是所有签名场景共用的唯一入口：过滤掉空值字段和 sign 自身，按 key 字典序排序后
+// 拼接成 k=v&...&key=KEY，再依据 signType 选择 MD5 或 HMAC-SHA256。
+// 取代过去 PrePayID、GetJSAPI、OrderQuery、OrderMchQuery、CheckSign 各自手写的 fmt.Sprintf 模板
+func Sign(params map[string]string, key, signType string) string {
+	keys := make([]string, 0, len(params))
+	for k, v := range params {
+		if k == "sign" || v == "" {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(params[k])
+		b.WriteByte('&')
+	}
+	b.WriteString("key=")
+	b.WriteString(key)
+	str := b.String()
+	if signType == SignTypeHMACSHA256 {
+		return hmacSHA256Sign(str, key)
+	}
+	return util.MD5Sum(str)
+}
+
+// signType 返回 pcf.SignType，未设置时回退到 MD5，保持与旧版行为一致
+func (pcf *Pay) signType() string {
+	if pcf.SignType == "" {
+		return SignTypeMD5
+	}
+	return pcf.SignType
+}
+
+func hmacSHA256Sign(str, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(str))
+	return strings.ToUpper(hex.EncodeToString(mac.Sum(nil)))
+}
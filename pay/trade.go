@@ -0,0 +1,157 @@
+package pay
+
+import (
+	"encoding/xml"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aimo-x/wechat/util"
+)
+
+const micropayPath = "/pay/micropay"
+
+// NativeOrder 发起 Native（扫码）下单，p.ProductID 必填，返回用于生成二维码的 code_url
+func (pcf *Pay) NativeOrder(p *UnifiedorderParams) (codeURL string, err error) {
+	if p.ProductID == "" {
+		return "", errors.New("[msg : missingProductID] NATIVE下单需要 ProductID")
+	}
+	p.TradeType = "NATIVE"
+	ret, err := pcf.unifiedOrder(p)
+	if err != nil {
+		return "", err
+	}
+	return ret.CodeURL, nil
+}
+
+// H5Order 发起 H5/MWEB 下单，p.SceneInfo 必填（已序列化为 JSON 的 h5_info），返回用于跳转拉起支付的 mweb_url
+func (pcf *Pay) H5Order(p *UnifiedorderParams) (mwebURL string, err error) {
+	if p.SceneInfo == "" {
+		return "", errors.New("[msg : missingSceneInfo] MWEB下单需要 SceneInfo")
+	}
+	p.TradeType = "MWEB"
+	ret, err := pcf.unifiedOrder(p)
+	if err != nil {
+		return "", err
+	}
+	return ret.MWebURL, nil
+}
+
+// AppPayRequest 是提交给移动端 SDK 发起支付所需的参数，字段名与微信 APP SDK 要求的大小写保持一致
+type AppPayRequest struct {
+	AppID     string `json:"appid"`
+	PartnerID string `json:"partnerid"`
+	PrepayID  string `json:"prepayid"`
+	Package   string `json:"package"`
+	NonceStr  string `json:"noncestr"`
+	Timestamp string `json:"timestamp"`
+	Sign      string `json:"sign"`
+}
+
+// AppOrder 发起 APP 下单，返回可直接交给移动端 SDK 调起支付的签名参数
+func (pcf *Pay) AppOrder(p *UnifiedorderParams) (*AppPayRequest, error) {
+	p.TradeType = "APP"
+	ret, err := pcf.unifiedOrder(p)
+	if err != nil {
+		return nil, err
+	}
+	nonceStr := util.RandomStr(32)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signType := pcf.signType()
+	sign := Sign(map[string]string{
+		"appid":     pcf.AppID,
+		"partnerid": pcf.PayMchID,
+		"prepayid":  ret.PrePayID,
+		"package":   "Sign=WXPay",
+		"noncestr":  nonceStr,
+		"timestamp": timestamp,
+	}, pcf.PayKey, signType)
+	return &AppPayRequest{
+		AppID:     pcf.AppID,
+		PartnerID: pcf.PayMchID,
+		PrepayID:  ret.PrePayID,
+		Package:   "Sign=WXPay",
+		NonceStr:  nonceStr,
+		Timestamp: timestamp,
+		Sign:      sign,
+	}, nil
+}
+
+type micropayRequest struct {
+	AppID          string `xml:"appid"`
+	MchID          string `xml:"mch_id"`
+	NonceStr       string `xml:"nonce_str"`
+	Sign           string `xml:"sign"`
+	Body           string `xml:"body"`
+	OutTradeNo     string `xml:"out_trade_no"`
+	TotalFee       string `xml:"total_fee"`
+	FeeType        string `xml:"fee_type,omitempty"`
+	SpbillCreateIP string `xml:"spbill_create_ip"`
+	AuthCode       string `xml:"auth_code"`
+}
+
+// micropayPollInterval、micropayMaxPolls 控制 Micropay 在 USERPAYING 状态下轮询 OrderQuery 的节奏，
+// 与微信文档建议的"15s/30s 间隔，累计不超过5分钟"保持同一量级
+var (
+	micropayPollInterval = 5 * time.Second
+	micropayMaxPolls     = 10
+)
+
+// Micropay 发起付款码支付（刷卡支付）。当返回 USERPAYING 时会轮询 OrderQuery 直到支付完成、超时或失败，
+// 超时后调用方应调用 Reverse 撤销订单，避免用户稍后完成支付但商户已判定失败导致的资金风险
+func (pcf *Pay) Micropay(authCode string, p *UnifiedorderParams) (*OrderQueryResult, error) {
+	nonceStr := util.RandomStr(32)
+	signType := pcf.signType()
+	sign := Sign(map[string]string{
+		"appid":            pcf.AppID,
+		"mch_id":           pcf.PayMchID,
+		"nonce_str":        nonceStr,
+		"body":             p.Body,
+		"out_trade_no":     p.OutTradeNo,
+		"total_fee":        p.TotalFee,
+		"fee_type":         p.FeeType,
+		"spbill_create_ip": p.CreateIP,
+		"auth_code":        authCode,
+	}, pcf.PayKey, signType)
+	request := micropayRequest{
+		AppID:          pcf.AppID,
+		MchID:          pcf.PayMchID,
+		NonceStr:       nonceStr,
+		Sign:           sign,
+		Body:           p.Body,
+		OutTradeNo:     p.OutTradeNo,
+		TotalFee:       p.TotalFee,
+		FeeType:        p.FeeType,
+		SpbillCreateIP: p.CreateIP,
+		AuthCode:       authCode,
+	}
+	rawRet, err := pcf.transport().Post(micropayPath, request)
+	if err != nil {
+		return nil, err
+	}
+	oqr := OrderQueryResult{}
+	if err := xml.Unmarshal(rawRet, &oqr); err != nil {
+		return nil, err
+	}
+	if oqr.ReturnCode != "SUCCESS" {
+		return nil, errors.New("[msg : xmlUnmarshalError] [rawReturn : " + string(rawRet) + "]")
+	}
+	if oqr.ErrCode != "USERPAYING" {
+		if oqr.ResultCode != "SUCCESS" {
+			return nil, errors.New(oqr.ErrCode + oqr.ErrCodeDes)
+		}
+		return &oqr, nil
+	}
+	for i := 0; i < micropayMaxPolls; i++ {
+		time.Sleep(micropayPollInterval)
+		result, err := pcf.OrderQuery(p.OutTradeNo)
+		if err != nil {
+			return nil, err
+		}
+		if result.TradeState == "USERPAYING" {
+			continue
+		}
+		return result, nil
+	}
+	return nil, errors.New("[msg : micropayTimeout] 用户支付中，轮询超时，请调用 Reverse 撤销订单")
+}
@@ -0,0 +1,148 @@
+package pay
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// Transport 是每一次商户 API 调用共用的传输层：重试、超时、主备域名切换都在这里统一处理，
+// 取代过去 OrderQuery 里手写的"失败了换 api2 host 重试一次"逻辑
+type Transport struct {
+	PrimaryHost       string                          // 主域名，defaultTransport 中为 https://api.mch.weixin.qq.com
+	BackupHost        string                          // 备用域名，defaultTransport 中为 https://api2.mch.weixin.qq.com；非空时各次尝试在主备host间轮换，为空时只用 PrimaryHost
+	MaxAttempts       int                             // 最大尝试次数（含首次），defaultTransport 中为 2，小于1时按1次处理
+	PerAttemptTimeout time.Duration                   // 单次尝试的超时时间，defaultTransport 中为 10s，为0时沿用 Client 自身的超时设置
+	Backoff           func(attempt int) time.Duration // 重试退避策略，默认指数退避+随机抖动
+	Client            *http.Client                    // 默认 http.DefaultClient；mTLS 等场景可注入自定义 client
+
+	// OnRequest/OnResponse 用于接入 OpenTelemetry/日志等可观测性设施，attempt 从0开始计数
+	OnRequest  func(attempt int, host, path string)
+	OnResponse func(attempt int, host, path string, err error)
+}
+
+// retryableReturnMsgs 是微信返回 return_code=FAIL 时，值得重试的 return_msg 集合
+var retryableReturnMsgs = map[string]bool{
+	"SYSTEMERROR":       true,
+	"BIZERR_NEED_RETRY": true,
+	"系统繁忙，请稍后再试":        true,
+}
+
+// defaultTransport 是 Pay 未显式配置 Transport 时使用的默认实例；PayV3 的请求不经过 Transport
+var defaultTransport = &Transport{
+	PrimaryHost:       "https://api.mch.weixin.qq.com",
+	BackupHost:        "https://api2.mch.weixin.qq.com",
+	MaxAttempts:       2,
+	PerAttemptTimeout: 10 * time.Second,
+}
+
+// Post 以 path（如 "/pay/unifiedorder"）向 PrimaryHost 发起 XML 请求，非2xx、DNS/TCP失败、
+// 或 return_code=FAIL 且 return_msg 可重试时，按 Backoff 等待后换 BackupHost 重试
+func (t *Transport) Post(path string, payload interface{}) ([]byte, error) {
+	return t.post(path, payload, t.Client)
+}
+
+// post 是 Post 的内部实现，允许调用方（如需要 mTLS 的 Refund/Reverse）传入覆盖的 *http.Client
+func (t *Transport) post(path string, payload interface{}, client *http.Client) ([]byte, error) {
+	hosts := []string{t.PrimaryHost}
+	if t.BackupHost != "" {
+		hosts = append(hosts, t.BackupHost)
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+	maxAttempts := t.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		host := hosts[attempt%len(hosts)]
+		url := host + path
+
+		attemptClient := client
+		if t.PerAttemptTimeout > 0 {
+			c := *client
+			c.Timeout = t.PerAttemptTimeout
+			attemptClient = &c
+		}
+
+		if t.OnRequest != nil {
+			t.OnRequest(attempt, host, path)
+		}
+		raw, err := postXMLWithClient(url, payload, attemptClient)
+		if err == nil {
+			if retryable, msg := retryableWeChatError(raw); retryable {
+				err = errors.New("[msg : retryableWeChatError] [return_msg : " + msg + "]")
+			}
+		}
+		if t.OnResponse != nil {
+			t.OnResponse(attempt, host, path, err)
+		}
+		if err == nil {
+			return raw, nil
+		}
+		lastErr = err
+		if attempt < maxAttempts-1 {
+			time.Sleep(t.backoffFor(attempt))
+		}
+	}
+	return nil, lastErr
+}
+
+// postXMLWithClient 把 payload 编码为 XML 后用给定 client 发起 POST，用于需要按次覆盖
+// 超时/证书的场景；util 包目前只提供不带 client 参数的 PostXML
+func postXMLWithClient(url string, payload interface{}, client *http.Client) ([]byte, error) {
+	body, err := xml.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, errors.New("[msg : httpError] [status : " + resp.Status + "]")
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (t *Transport) backoffFor(attempt int) time.Duration {
+	if t.Backoff != nil {
+		return t.Backoff(attempt)
+	}
+	base := 200 * time.Millisecond << uint(attempt)
+	jitter := time.Duration(rand.Int63n(int64(base/2) + 1))
+	return base + jitter
+}
+
+// retryableWeChatError 检查响应是否是 return_code=FAIL 且 return_msg 属于可重试错误
+func retryableWeChatError(raw []byte) (bool, string) {
+	var fields xmlFields
+	if err := xml.Unmarshal(raw, &fields); err != nil {
+		return false, ""
+	}
+	if fields["return_code"] != "FAIL" {
+		return false, ""
+	}
+	return retryableReturnMsgs[fields["return_msg"]], fields["return_msg"]
+}
+
+// transport 返回 pcf.Transport，未配置时回退到 defaultTransport
+func (pcf *Pay) transport() *Transport {
+	if pcf.Transport != nil {
+		return pcf.Transport
+	}
+	return defaultTransport
+}